@@ -0,0 +1,164 @@
+package xmodem
+
+import (
+	"bufio"
+	"context"
+	"sync"
+	"time"
+)
+
+// RetryPolicy bounds how long a transfer waits for the peer and how many
+// times it retries before giving up. It replaces the fixed limits (10
+// NAKs, 2 CANs, 3 handshake attempts) this package used to hard-code.
+type RetryPolicy struct {
+	CharTimeout      time.Duration // max wait for a single control byte (ACK/NAK/CAN); 0 disables the timeout
+	PacketTimeout    time.Duration // max wait for a full packet body; 0 disables the timeout
+	HandshakeTimeout time.Duration // max wait per mode-probe attempt; 0 disables the timeout
+
+	MaxNAKs           int // consecutive NAKs before a packet send gives up
+	MaxCANs           int // consecutive CANs before a packet send gives up
+	HandshakeAttempts int // probe attempts before the mode negotiation gives up
+}
+
+// DefaultRetryPolicy matches the behavior this package had before
+// RetryPolicy existed: no timeouts, 10 NAKs, 2 CANs, 3 handshake attempts.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxNAKs:           10,
+	MaxCANs:           2,
+	HandshakeAttempts: 3,
+}
+
+// transportPump is the only goroutine that ever calls Read on the
+// underlying *bufio.Reader. readCtx/peekCtx used to spawn a fresh goroutine
+// per call and abandon it on timeout/cancellation, which left a Read/Peek
+// in flight against the same *bufio.Reader a retry would immediately call
+// into again - an unsynchronized concurrent access, and one where the
+// abandoned call could win the race and consume the byte the retry was
+// waiting for. The pump instead drains the reader continuously into a
+// buffer that readCtx/peekCtx only ever peek or pop under a mutex, so a
+// timed-out wait never leaves anything in flight and never loses a byte.
+type transportPump struct {
+	mu   sync.Mutex
+	buf  []byte
+	err  error
+	wake chan struct{} // closed and replaced whenever buf grows or err is set
+}
+
+func newTransportPump(r *bufio.Reader) *transportPump {
+	p := &transportPump{wake: make(chan struct{})}
+	go p.run(r)
+	return p
+}
+
+func (p *transportPump) run(r *bufio.Reader) {
+	chunk := make([]byte, 1024)
+	for {
+		n, err := r.Read(chunk)
+		p.mu.Lock()
+		if n > 0 {
+			p.buf = append(p.buf, chunk[:n]...)
+		}
+		if err != nil {
+			p.err = err
+		}
+		close(p.wake)
+		p.wake = make(chan struct{})
+		p.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// wait returns the channel that's closed the next time the pump makes
+// progress, to select on alongside ctx.Done()/a timeout.
+func (p *transportPump) wait() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.wake
+}
+
+// tryRead pops up to len(buf) bytes already pumped, same as one io.Reader
+// Read call would. ok is false if nothing is buffered and there's no error
+// yet, meaning the caller should wait and try again.
+func (p *transportPump) tryRead(buf []byte) (n int, err error, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) > 0 {
+		n = copy(buf, p.buf)
+		p.buf = p.buf[n:]
+		return n, nil, true
+	}
+	if p.err != nil {
+		return 0, p.err, true
+	}
+	return 0, nil, false
+}
+
+// tryPeek returns the next n bytes without consuming them, once that many
+// are buffered.
+func (p *transportPump) tryPeek(n int) (buf []byte, err error, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) >= n {
+		out := make([]byte, n)
+		copy(out, p.buf[:n])
+		return out, nil, true
+	}
+	if p.err != nil {
+		return nil, p.err, true
+	}
+	return nil, nil, false
+}
+
+// consume drops n already-peeked bytes.
+func (p *transportPump) consume(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n > len(p.buf) {
+		n = len(p.buf)
+	}
+	p.buf = p.buf[n:]
+}
+
+func (m *Modem) readCtx(ctx context.Context, timeout time.Duration, buf []byte) (int, error) {
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	for {
+		if n, err, ok := m.pump.tryRead(buf); ok {
+			return n, err
+		}
+		select {
+		case <-m.pump.wait():
+		case <-timeoutCh:
+			return 0, context.DeadlineExceeded
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+func (m *Modem) peekCtx(ctx context.Context, timeout time.Duration, n int) ([]byte, error) {
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	for {
+		if buf, err, ok := m.pump.tryPeek(n); ok {
+			return buf, err
+		}
+		select {
+		case <-m.pump.wait():
+		case <-timeoutCh:
+			return nil, context.DeadlineExceeded
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
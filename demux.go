@@ -0,0 +1,248 @@
+package xmodem
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ringBuffer is a small concurrent byte queue: Write appends and never
+// blocks, Read blocks until data is available or the buffer is closed.
+// Unlike io.Pipe, a slow or absent reader can't stall the writer, so the
+// demultiplexer below can push into it from a single goroutine without
+// pairing it with a matching "discard" reader.
+type ringBuffer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+	err    error
+}
+
+func newRingBuffer() *ringBuffer {
+	rb := &ringBuffer{}
+	rb.cond = sync.NewCond(&rb.mu)
+	return rb
+}
+
+func (rb *ringBuffer) Write(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := rb.buf.Write(p)
+	rb.cond.Broadcast()
+	return n, err
+}
+
+func (rb *ringBuffer) Read(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for rb.buf.Len() == 0 && !rb.closed {
+		rb.cond.Wait()
+	}
+	if rb.buf.Len() == 0 {
+		if rb.err != nil {
+			return 0, rb.err
+		}
+		return 0, io.EOF
+	}
+	return rb.buf.Read(p)
+}
+
+// WriteTo drains the buffer directly into w as data arrives, letting a
+// caller splice a Modem's filtered reader into a net.Conn or os.File
+// without an extra copy through their own buffer.
+func (rb *ringBuffer) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	buf := make([]byte, 4096)
+	for {
+		n, err := rb.Read(buf)
+		if n > 0 {
+			wn, werr := w.Write(buf[:n])
+			total += int64(wn)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+}
+
+func (rb *ringBuffer) CloseWithError(err error) error {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.closed = true
+	rb.err = err
+	rb.cond.Broadcast()
+	return nil
+}
+
+func (rb *ringBuffer) Close() error {
+	return rb.CloseWithError(nil)
+}
+
+// demux routes bytes arriving from the transport to either the terminal
+// sink or the modem sink depending on which one currently owns the link,
+// and routes bytes written by the terminal side either straight through to
+// the transport or, while the modem owns the link, into a cache that's
+// flushed once the modem gives the link back. Both directions go through
+// transport's EncodePacket/DecodeStream, the same as the protocol's own
+// reads and writes, so an escaped/8-bit-unsafe link (Telnet IAC, XON/XOFF)
+// is handled for terminal passthrough too, not just during a transfer.
+type demux struct {
+	mu        sync.Mutex // guards writer, which write/deactivate also read; reader is only ever set here, run() gets its own decoded copy
+	reader    io.Reader
+	writer    io.Writer
+	transport Transport
+
+	active int32 // 0: terminal owns the link, 1: modem owns it
+	gen    int32 // run() generation; a superseded run stops instead of writing
+
+	termR *ringBuffer // bytes for the caller's filtered Reader
+	modem *ringBuffer // bytes for the Modem's protocol reader
+
+	cacheMu sync.Mutex
+	cache   bytes.Buffer // terminal writes queued while the modem owns the link
+}
+
+func newDemux(reader io.Reader, writer io.Writer, transport Transport) *demux {
+	d := &demux{
+		reader:    reader,
+		writer:    writer,
+		transport: transport,
+		termR:     newRingBuffer(),
+		modem:     newRingBuffer(),
+	}
+	d.run(transport.DecodeStream(reader))
+	return d
+}
+
+// run pumps reader into termR/modem until it errors or a later call to run
+// (AttachTransport rebinding to a new reader) supersedes it. A superseded
+// run stops as soon as its in-flight Read returns, instead of going on to
+// merge bytes from a reader that's no longer the one in use - which is
+// what let bytes from the old and new transport interleave before. reader
+// is expected to already be decoded (see transport.DecodeStream above and
+// AttachTransport below), so termR and modem both see the same framing the
+// protocol reads.
+func (d *demux) run(reader io.Reader) {
+	gen := atomic.AddInt32(&d.gen, 1)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := reader.Read(buf)
+			if atomic.LoadInt32(&d.gen) != gen {
+				return
+			}
+			if n > 0 {
+				if atomic.LoadInt32(&d.active) == 0 {
+					d.termR.Write(buf[:n])
+				} else {
+					d.modem.Write(buf[:n])
+				}
+			}
+			if err != nil {
+				d.termR.CloseWithError(err)
+				d.modem.CloseWithError(err)
+				return
+			}
+		}
+	}()
+}
+
+// activate gives the modem ownership of the link.
+func (d *demux) activate() {
+	atomic.StoreInt32(&d.active, 1)
+}
+
+// deactivate gives the terminal back ownership of the link and flushes
+// whatever it queued while the modem was transferring.
+func (d *demux) deactivate() {
+	atomic.StoreInt32(&d.active, 0)
+	d.cacheMu.Lock()
+	defer d.cacheMu.Unlock()
+	if d.cache.Len() > 0 {
+		d.mu.Lock()
+		d.writer.Write(d.cache.Bytes())
+		d.mu.Unlock()
+		d.cache.Reset()
+	}
+}
+
+// write encodes p through transport before it reaches writer/cache, but
+// still reports how much of p it consumed rather than how many encoded
+// bytes that turned into, so it honors io.Writer's contract even when
+// EncodePacket changes p's length (TelnetTransport doubling an IAC,
+// EscapedTransport's ZDLE escaping) - a caller retrying a short write off
+// the returned n would otherwise reslice p by the wrong amount.
+func (d *demux) write(p []byte) (int, error) {
+	enc := d.transport.EncodePacket(p)
+	if atomic.LoadInt32(&d.active) == 0 {
+		d.mu.Lock()
+		_, err := d.writer.Write(enc)
+		d.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	d.cacheMu.Lock()
+	defer d.cacheMu.Unlock()
+	if _, err := d.cache.Write(enc); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// termWriter is the filtered io.Writer handed back to the caller by
+// NewModem. Its ReadFrom lets a caller splice a net.Conn or os.File
+// straight into the modem without bouncing through an intermediate
+// buffer the way io.Copy would have to without it.
+type termWriter struct {
+	d *demux
+}
+
+func (w termWriter) Write(p []byte) (int, error) {
+	return w.d.write(p)
+}
+
+func (w termWriter) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, werr := w.d.write(buf[:n]); werr != nil {
+				return total, werr
+			}
+			total += int64(n)
+		}
+		if err != nil {
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+	}
+}
+
+// AttachTransport rebinds the modem to rw, using it for both directions.
+// It's meant to be called once, right after NewModem and before the first
+// transfer, for full-duplex links (net.Conn, ssh.Session) where splitting
+// reader and writer by hand is unnecessary.
+func (m *Modem) AttachTransport(rw io.ReadWriter) {
+	m.demux.mu.Lock()
+	m.demux.reader = rw
+	m.demux.writer = rw
+	m.demux.mu.Unlock()
+	m.transportW = rw
+	m.demux.run(m.Config.Transport.DecodeStream(rw))
+}
@@ -3,11 +3,11 @@ package xmodem
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"sync/atomic"
 	"time"
 )
 
@@ -25,7 +25,7 @@ var IOCan = errors.New("send/receive break")
 const (
 	XModem modemMode = iota
 	YModem
-	//ZModem // current don't support ZModem
+	ZModem
 )
 
 type ModemFn uint32
@@ -40,117 +40,89 @@ const (
 	ModemXMax = ModemXMin | ModemFn1k | ModemFnCRC | ModemFnCANCAN
 	ModemYMin = ModemXMax | ModemFnBatch
 	ModemYMax = ModemYMin | ModemFnG
+	ModemZMin = 0
+	ModemZMax = ModemZMin | ModemFn1k | ModemFnCRC | ModemFnCANCAN | ModemFnBatch | ModemFnG
 )
 
 type ModemConfig struct {
 	mode modemMode
 	fn   ModemFn
+
+	// Retry bounds how long the transfer waits for the peer and how many
+	// times it retries before giving up. Set by XModemConfig/YModemConfig/
+	// ZModemConfig to DefaultRetryPolicy; overwrite it on the returned
+	// ModemConfig to customize it.
+	Retry RetryPolicy
+
+	// Progress, if set, is notified of handshake/packet/file events as the
+	// transfer runs. Nil by default.
+	Progress ProgressHandler
+
+	// Transport frames the byte stream for links that can't pass the
+	// protocol's control bytes unmodified (Telnet, XON/XOFF-sensitive
+	// serial servers). RawTransport{} by default, set by
+	// XModemConfig/YModemConfig/ZModemConfig; overwrite it on the returned
+	// ModemConfig to customize it.
+	Transport Transport
+
+	// ResumeFrom, if set, is called with the incoming File (before its Body
+	// is readable) when receiving over ZModem, and its return value is
+	// requested from the sender via ZRPOS instead of always restarting at
+	// 0. Use it to check for an existing partial download and resume it.
+	// Only consulted when the ZModemConfig fn includes ModemFn1k (crash
+	// recovery). Unused outside ZModem.
+	ResumeFrom func(file File) int64
 }
 
 func XModemConfig(fn ModemFn) ModemConfig {
 	return ModemConfig{
-		mode: XModem,
-		fn:   (fn & ModemXMax) | ModemXMin,
+		mode:      XModem,
+		fn:        (fn & ModemXMax) | ModemXMin,
+		Retry:     DefaultRetryPolicy,
+		Transport: RawTransport{},
 	}
 }
 
 func YModemConfig(fn ModemFn) ModemConfig {
 	return ModemConfig{
-		mode: YModem,
-		fn:   (fn & ModemYMax) | ModemYMin,
+		mode:      YModem,
+		fn:        (fn & ModemYMax) | ModemYMin,
+		Retry:     DefaultRetryPolicy,
+		Transport: RawTransport{},
 	}
 }
 
 type Modem struct {
-	termR      io.Writer
-	termWW     io.Writer
-	transportR *bufio.Reader
+	demux      *demux
+	termR      *ringBuffer // bytes that don't belong to the protocol get forwarded here
+	pump       *transportPump
 	transportW io.Writer
-	finishChan chan bool
-	state      *int64
 	Config     ModemConfig
 }
 
-// NewModem create a modem adapter over a (reader, writer), return the modem and a filtered (reader, writer).
+// NewModem create a modem adapter over a (reader, writer), return the modem
+// and a filtered (reader, writer). The filtered reader implements
+// io.WriterTo and the filtered writer implements io.ReaderFrom, so callers
+// can splice them into a net.Conn or os.File without an intermediate copy.
 func NewModem(config ModemConfig, reader io.Reader, writer io.Writer) (*Modem, io.Reader, io.Writer) {
-	rr, rw := io.Pipe()
-	wr, ww := io.Pipe()
-
-	mrr, mrw := io.Pipe()
-
-	modemR := bufio.NewReader(mrr)
-
-	finishChan := make(chan bool, 1)
-	modemState := new(int64)
-	*modemState = 0
-
-	go func() {
-		buf := make([]byte, 1024)
-		for {
-			n, err := reader.Read(buf)
-			if err != nil && err != io.EOF {
-				rw.CloseWithError(err)
-				mrw.CloseWithError(err)
-				return
-			}
-			if atomic.LoadInt64(modemState) == 0 {
-				rw.Write(buf[:n])
-				go func() {
-					modemR.Read(make([]byte, n))
-				}()
-				mrw.Write(buf[:n])
-			} else {
-				mrw.Write(buf[:n])
-			}
-			if err == io.EOF {
-				rw.Close()
-				mrw.Close()
-				return
-			}
-		}
-	}()
-
-	go func() {
-		buf := make([]byte, 1024)
-		cache := &bytes.Buffer{}
-		for {
-			select {
-			case <-finishChan:
-				writer.Write(cache.Bytes())
-				cache.Reset()
-				atomic.StoreInt64(modemState, 0)
-				go func() {
-					modemR.Read(make([]byte, 1024))
-				}()
-				break
-			default:
-				n, err := wr.Read(buf)
-				if err != nil && err != io.EOF {
-					return
-				}
-				if atomic.LoadInt64(modemState) == 0 {
-					writer.Write(buf[:n])
-				} else {
-					cache.Write(buf[:n])
-				}
-				if err == io.EOF {
-					return
-				}
-			}
-		}
-	}()
+	d := newDemux(reader, writer, config.Transport)
 
 	modem := &Modem{
-		termR:      rw,
-		termWW:     ww,
-		transportR: modemR,
+		demux:      d,
+		termR:      d.termR,
+		pump:       newTransportPump(bufio.NewReader(d.modem)),
 		transportW: writer,
-		finishChan: finishChan,
-		state:      modemState,
 		Config:     config,
 	}
 
-	return modem, rr, ww
+	return modem, d.termR, termWriter{d: d}
+}
+
+// writeTransport encodes data through Config.Transport before writing it to
+// the underlying transport, so sendPack/receivePack/SendBreak never need to
+// know whether they're talking to a raw link or a framed one.
+func (m *Modem) writeTransport(data []byte) (int, error) {
+	return m.transportW.Write(m.Config.Transport.EncodePacket(data))
 }
 
 const (
@@ -188,11 +160,11 @@ func crc16(data []byte) []byte {
 	return []byte{byte(crc >> 8), byte(crc & 0xff)}
 }
 
-func (m *Modem) waitWorkMode() (byte, error) {
+func (m *Modem) waitWorkMode(ctx context.Context) (byte, error) {
 	workMode := charNAK
 	for {
 		rBuf := make([]byte, 1)
-		_, err := m.transportR.Read(rBuf)
+		_, err := m.readCtx(ctx, m.Config.Retry.HandshakeTimeout, rBuf)
 		if err != nil {
 			return 0, err
 		}
@@ -202,10 +174,11 @@ func (m *Modem) waitWorkMode() (byte, error) {
 		}
 		m.termR.Write(rBuf[:1])
 	}
+	m.progress(ProgressEvent{Kind: ProgressHandshake})
 	return workMode, nil
 }
 
-func (m *Modem) sendPack(index uint8, data []byte, mode byte) error {
+func (m *Modem) sendPack(ctx context.Context, index uint8, data []byte, mode byte) error {
 	header := charSOH
 	if len(data) == 1024 {
 		header = charSTX
@@ -220,26 +193,30 @@ func (m *Modem) sendPack(index uint8, data []byte, mode byte) error {
 	count := 0
 	can := 0
 	for {
-		m.transportW.Write(buf)
+		m.writeTransport(buf)
+		m.progress(ProgressEvent{Kind: ProgressPacketSent, Index: int(index), Size: len(data)})
 		if mode == charG {
 			break
 		}
-		_, err := m.transportR.Read(rBuf)
+		_, err := m.readCtx(ctx, m.Config.Retry.CharTimeout, rBuf)
 		if err != nil {
 			return err
 		}
 		if rBuf[0] == charCAN {
 			can += 1
-			if can >= 2 {
+			m.progress(ProgressEvent{Kind: ProgressCAN, Index: int(index)})
+			if can >= m.Config.Retry.MaxCANs {
 				return IOCan
 			}
 		} else {
 			can = 0
 			if rBuf[0] == charACK {
+				m.progress(ProgressEvent{Kind: ProgressPacketAcked, Index: int(index), Size: len(data)})
 				break
 			} else if rBuf[0] == charNAK {
 				count += 1
-				if count >= 10 {
+				m.progress(ProgressEvent{Kind: ProgressRetransmit, Index: int(index)})
+				if count >= m.Config.Retry.MaxNAKs {
 					return NAKTenTimes
 				}
 			} else {
@@ -250,28 +227,29 @@ func (m *Modem) sendPack(index uint8, data []byte, mode byte) error {
 	return nil
 }
 
-func (m *Modem) sendEOT() error {
+func (m *Modem) sendEOT(ctx context.Context) error {
 	rBuf := make([]byte, 1)
 	count := 0
 	can := 0
 	for {
-		m.transportW.Write([]byte{charEOT})
-		_, err := m.transportR.Read(rBuf)
+		m.writeTransport([]byte{charEOT})
+		_, err := m.readCtx(ctx, m.Config.Retry.CharTimeout, rBuf)
 		if err != nil {
 			return err
 		}
 		if rBuf[0] == charCAN {
 			can += 1
-			if can >= 2 {
+			if can >= m.Config.Retry.MaxCANs {
 				return IOCan
 			}
 		} else {
 			can = 0
 			if rBuf[0] == charACK {
+				m.progress(ProgressEvent{Kind: ProgressEOT})
 				break
 			} else if rBuf[0] == charNAK {
 				count += 1
-				if count >= 10 {
+				if count >= m.Config.Retry.MaxNAKs {
 					return NAKTenTimes
 				}
 			} else {
@@ -282,35 +260,53 @@ func (m *Modem) sendEOT() error {
 	return nil
 }
 
+// SendBreak cancels an in-flight transfer, same as SendBreakContext(context.Background()).
 func (m *Modem) SendBreak() error {
+	return m.SendBreakContext(context.Background())
+}
+
+// SendBreakContext cancels an in-flight transfer, emitting CAN CAN for
+// XModem/YModem (or EOT if the peer doesn't understand CAN CAN), and the
+// ZMODEM abort sequence for ZModem.
+func (m *Modem) SendBreakContext(ctx context.Context) error {
+	if m.Config.mode == ZModem {
+		_, err := m.writeTransport([]byte{charCAN, charCAN, charCAN, charCAN, charCAN})
+		return err
+	}
 	if m.Config.fn&ModemFnCANCAN != 0 {
-		m.transportW.Write([]byte{charCAN, charCAN})
+		m.writeTransport([]byte{charCAN, charCAN})
 	} else {
-		return m.sendEOT()
+		return m.sendEOT(ctx)
 	}
 	return nil
 }
 
-// SendBytes send a file.
+// SendBytes send a file, same as SendBytesContext(context.Background(), file).
 func (m *Modem) SendBytes(file io.Reader) error {
-	atomic.StoreInt64(m.state, 1)
-	m.transportR.UnreadByte()
-	err := m.sendBytes(file)
+	return m.SendBytesContext(context.Background(), file)
+}
+
+// SendBytesContext sends a file, aborting the transfer if ctx is cancelled
+// before it completes.
+func (m *Modem) SendBytesContext(ctx context.Context, file io.Reader) error {
+	m.demux.activate()
+	err := m.sendBytes(ctx, file)
 	if err != nil && err != io.EOF && err != TooLongFileInfo && err != IOCan {
-		m.SendBreak()
+		m.SendBreakContext(ctx)
 	}
-	m.finishChan <- true
-	// force flush cache
-	m.termWW.Write([]byte{})
+	m.demux.deactivate()
 	return err
 }
 
-func (m *Modem) sendBytes(file io.Reader) error {
-	workMode, err := m.waitWorkMode()
+func (m *Modem) sendBytes(ctx context.Context, file io.Reader) error {
+	if m.Config.mode == ZModem {
+		return m.sendZModem(ctx, []File{{Body: file}})
+	}
+	workMode, err := m.waitWorkMode(ctx)
 	if err != nil {
 		return err
 	}
-	return m.sendBuffer(file, 0, workMode)
+	return m.sendBuffer(ctx, file, 0, workMode)
 }
 
 type File struct {
@@ -319,23 +315,39 @@ type File struct {
 	ModTime time.Time
 	Mode    fs.FileMode
 	Body    io.Reader
+
+	// ResumeOffset is only meaningful for ZModem. On SendList it is sent to
+	// the peer in the ZFILE info, where the receiver's ModemConfig.ResumeFrom
+	// sees it on the incoming File; Body is skipped forward to the offset the
+	// receiver then requests via ZRPOS, not to ResumeOffset itself. On
+	// Receive it reports the offset ModemConfig.ResumeFrom requested (0 if
+	// unset or crash recovery is off), so the Receiver can open its
+	// destination in append mode instead of truncating it.
+	ResumeOffset int64
 }
 
-// SendList send a list of files, only for YModem.
+// SendList send a list of files, only for YModem and ZModem, same as
+// SendListContext(context.Background(), files).
 func (m *Modem) SendList(files []File) error {
-	atomic.StoreInt64(m.state, 1)
-	m.transportR.UnreadByte()
-	err := m.sendList(files)
+	return m.SendListContext(context.Background(), files)
+}
+
+// SendListContext sends a list of files, aborting the transfer if ctx is
+// cancelled before it completes.
+func (m *Modem) SendListContext(ctx context.Context, files []File) error {
+	m.demux.activate()
+	err := m.sendList(ctx, files)
 	if err != nil && err != io.EOF && err != TooLongFileInfo {
-		m.SendBreak()
+		m.SendBreakContext(ctx)
 	}
-	m.finishChan <- true
-	// force flush cache
-	m.termWW.Write([]byte{})
+	m.demux.deactivate()
 	return err
 }
 
-func (m *Modem) sendList(files []File) error {
+func (m *Modem) sendList(ctx context.Context, files []File) error {
+	if m.Config.mode == ZModem {
+		return m.sendZModem(ctx, files)
+	}
 	if m.Config.mode == XModem {
 		return WrongModemType
 	}
@@ -343,7 +355,8 @@ func (m *Modem) sendList(files []File) error {
 		return WrongModemType
 	}
 	for _, file := range files {
-		workMode, err := m.waitWorkMode()
+		m.progress(ProgressEvent{Kind: ProgressFileStart, File: file})
+		workMode, err := m.waitWorkMode(ctx)
 		if err != nil {
 			return err
 		}
@@ -369,7 +382,7 @@ func (m *Modem) sendList(files []File) error {
 			info = append(info, make([]byte, 0, 1024-len(info))...)
 		}
 		// send file info
-		err = m.sendPack(0, info, workMode)
+		err = m.sendPack(ctx, 0, info, workMode)
 		if err != nil {
 			return err
 		}
@@ -377,19 +390,20 @@ func (m *Modem) sendList(files []File) error {
 			return TooLongFileInfo
 		}
 		// send body
-		err = m.sendBuffer(file.Body, file.Length, workMode)
+		err = m.sendBuffer(ctx, file.Body, file.Length, workMode)
 		if err != nil {
 			return err
 		}
+		m.progress(ProgressEvent{Kind: ProgressFileEnd, File: file})
 	}
-	workMode, err := m.waitWorkMode()
+	workMode, err := m.waitWorkMode(ctx)
 	if err != nil {
 		return err
 	}
-	return m.sendPack(0, make([]byte, 0, 128), workMode)
+	return m.sendPack(ctx, 0, make([]byte, 0, 128), workMode)
 }
 
-func (m *Modem) sendBuffer(file io.Reader, maxsize int64, workMode byte) error {
+func (m *Modem) sendBuffer(ctx context.Context, file io.Reader, maxsize int64, workMode byte) error {
 	buf := make([]byte, 128)
 	if m.Config.fn&ModemFn1k != 0 {
 		buf = make([]byte, 1024)
@@ -399,7 +413,7 @@ func (m *Modem) sendBuffer(file io.Reader, maxsize int64, workMode byte) error {
 	for {
 		n, err := io.ReadAtLeast(file, buf, len(buf))
 		if err == io.EOF && n == 0 {
-			return m.sendEOT()
+			return m.sendEOT(ctx)
 		}
 		if err != nil && err != io.ErrUnexpectedEOF {
 			return err
@@ -418,24 +432,26 @@ func (m *Modem) sendBuffer(file io.Reader, maxsize int64, workMode byte) error {
 				buf[i] = charSUB
 			}
 		}
-		err = m.sendPack(byte(index&0xff), buf, workMode)
+		err = m.sendPack(ctx, byte(index&0xff), buf, workMode)
 		index += 1
 		if err != nil {
 			return err
 		}
 		if fin {
-			return m.sendEOT()
+			return m.sendEOT(ctx)
 		}
 	}
 }
 
-func (m *Modem) tryWorkMode() (byte, error) {
+func (m *Modem) tryWorkMode(ctx context.Context) (byte, error) {
 	var err error
+	attempts := m.Config.Retry.HandshakeAttempts
 	if m.Config.fn&ModemFnG != 0 {
-		for i := 0; i < 3; i++ {
-			m.transportW.Write([]byte{charG})
-			_, err = m.transportR.Peek(1)
+		for i := 0; i < attempts; i++ {
+			m.writeTransport([]byte{charG})
+			_, err = m.peekCtx(ctx, m.Config.Retry.HandshakeTimeout, 1)
 			if err == nil {
+				m.progress(ProgressEvent{Kind: ProgressHandshake})
 				return charG, nil
 			} else if err != io.EOF {
 				continue
@@ -445,10 +461,11 @@ func (m *Modem) tryWorkMode() (byte, error) {
 		}
 	}
 	if m.Config.fn&ModemFnCRC != 0 {
-		for i := 0; i < 3; i++ {
-			m.transportW.Write([]byte{charCRC})
-			_, err = m.transportR.Peek(1)
+		for i := 0; i < attempts; i++ {
+			m.writeTransport([]byte{charCRC})
+			_, err = m.peekCtx(ctx, m.Config.Retry.HandshakeTimeout, 1)
 			if err == nil {
+				m.progress(ProgressEvent{Kind: ProgressHandshake})
 				return charCRC, nil
 			} else if err != io.EOF {
 				continue
@@ -457,10 +474,11 @@ func (m *Modem) tryWorkMode() (byte, error) {
 			}
 		}
 	}
-	for i := 0; i < 3; i++ {
-		m.transportW.Write([]byte{charNAK})
-		_, err = m.transportR.Peek(1)
+	for i := 0; i < attempts; i++ {
+		m.writeTransport([]byte{charNAK})
+		_, err = m.peekCtx(ctx, m.Config.Retry.HandshakeTimeout, 1)
 		if err == nil {
+			m.progress(ProgressEvent{Kind: ProgressHandshake})
 			return charNAK, nil
 		} else if err != io.EOF {
 			continue
@@ -471,7 +489,7 @@ func (m *Modem) tryWorkMode() (byte, error) {
 	return 0, err
 }
 
-func (m *Modem) receivePack(index byte, workMode byte) ([]byte, error) {
+func (m *Modem) receivePack(ctx context.Context, index byte, workMode byte) ([]byte, error) {
 	n := 2
 	if workMode == charNAK {
 		n += 1
@@ -480,7 +498,7 @@ func (m *Modem) receivePack(index byte, workMode byte) ([]byte, error) {
 	}
 	for {
 		rBuf := make([]byte, 1)
-		_, err := m.transportR.Read(rBuf)
+		_, err := m.readCtx(ctx, m.Config.Retry.CharTimeout, rBuf)
 		if err != nil {
 			return nil, err
 		}
@@ -490,36 +508,38 @@ func (m *Modem) receivePack(index byte, workMode byte) ([]byte, error) {
 				bn += 1024
 			}
 			buf := make([]byte, n+bn)
-			_, err := m.transportR.Read(buf)
+			_, err := m.readCtx(ctx, m.Config.Retry.PacketTimeout, buf)
 			if err != nil {
 				return nil, err
 			}
 			if buf[0]^buf[1] != 0xff || buf[0] != index {
 				if workMode != charG {
-					m.transportW.Write([]byte{charNAK})
+					m.writeTransport([]byte{charNAK})
 				} else {
 					return nil, GModeWithWrong
 				}
 			}
 			if workMode == charNAK {
 				if checksum(buf[2 : 2+bn])[0] != buf[2+bn] {
-					m.transportW.Write([]byte{charNAK})
+					m.writeTransport([]byte{charNAK})
 				}
 			} else {
 				crc := crc16(buf[2 : 2+bn])
 				if crc[0] != buf[2+bn] || crc[1] != buf[3+bn] {
 					if workMode != charG {
-						m.transportW.Write([]byte{charNAK})
+						m.writeTransport([]byte{charNAK})
 					} else {
 						return nil, GModeWithWrong
 					}
 				}
 			}
 			if workMode != charG {
-				m.transportW.Write([]byte{charACK})
+				m.writeTransport([]byte{charACK})
 			}
+			m.progress(ProgressEvent{Kind: ProgressPacketAcked, Index: int(index), Size: bn})
 			return buf[2 : 2+bn], nil
 		} else if rBuf[0] == charEOT {
+			m.progress(ProgressEvent{Kind: ProgressEOT})
 			return []byte{}, io.EOF
 		} else {
 			m.termR.Write(rBuf[:1])
@@ -551,26 +571,37 @@ func parseFileInfo(buf []byte) (*File, error) {
 
 type Receiver func(file File)
 
-// Receive receive file/files for any config.
+// Receive receive file/files for any config, same as
+// ReceiveContext(context.Background(), fn).
 func (m *Modem) Receive(fn Receiver) error {
-	atomic.StoreInt64(m.state, 1)
-	err := m.receive(fn)
-	m.finishChan <- true
-	// force flush cache
-	m.termWW.Write([]byte{})
+	return m.ReceiveContext(context.Background(), fn)
+}
+
+// ReceiveContext receives file/files for any config, aborting the transfer
+// if ctx is cancelled before it completes.
+func (m *Modem) ReceiveContext(ctx context.Context, fn Receiver) error {
+	m.demux.activate()
+	err := m.receive(ctx, fn)
+	if err != nil && err != IOCan {
+		m.SendBreakContext(ctx)
+	}
+	m.demux.deactivate()
 	return err
 }
 
-func (m *Modem) receive(fn Receiver) error {
+func (m *Modem) receive(ctx context.Context, fn Receiver) error {
+	if m.Config.mode == ZModem {
+		return m.receiveZModem(ctx, fn)
+	}
 	//ret := []File{}
 	for {
-		workMode, err := m.tryWorkMode()
+		workMode, err := m.tryWorkMode(ctx)
 		if err != nil {
 			return err
 		}
 		file := &File{}
 		if m.Config.fn&ModemFnBatch != 0 {
-			data, err := m.receivePack(0, workMode)
+			data, err := m.receivePack(ctx, 0, workMode)
 			if err != nil {
 				return err
 			}
@@ -579,6 +610,7 @@ func (m *Modem) receive(fn Receiver) error {
 				return err
 			}
 		}
+		m.progress(ProgressEvent{Kind: ProgressFileStart, File: *file})
 		index := byte(1)
 		//body := &bytes.Buffer{}
 		br, bw := io.Pipe()
@@ -588,7 +620,7 @@ func (m *Modem) receive(fn Receiver) error {
 		}()
 		writed := int64(0)
 		for {
-			data, err := m.receivePack(index, workMode)
+			data, err := m.receivePack(ctx, index, workMode)
 			if err != nil && err != io.EOF {
 				bw.Close()
 				return err
@@ -600,11 +632,12 @@ func (m *Modem) receive(fn Receiver) error {
 			writed += int64(len(data))
 			bw.Write(data)
 			if err == io.EOF {
-				m.transportW.Write([]byte{charACK})
+				m.writeTransport([]byte{charACK})
 				break
 			}
 		}
 		bw.Close()
+		m.progress(ProgressEvent{Kind: ProgressFileEnd, File: *file})
 		if m.Config.fn&ModemFnBatch == 0 {
 			break
 		}
@@ -0,0 +1,90 @@
+package xmodem
+
+import (
+	"fmt"
+	"io"
+)
+
+// ProgressEventKind identifies what a ProgressEvent reports.
+type ProgressEventKind int
+
+const (
+	ProgressHandshake   ProgressEventKind = iota // mode negotiation finished
+	ProgressPacketSent                           // a data packet was written
+	ProgressPacketAcked                          // the peer acknowledged a packet (ACK, or a clean receive)
+	ProgressRetransmit                           // a packet was resent after a NAK
+	ProgressCAN                                  // the peer answered a packet with CAN
+	ProgressEOT                                  // EOT was exchanged
+	ProgressFileStart                            // a file's transfer started
+	ProgressFileEnd                              // a file's transfer finished
+)
+
+// ProgressEvent describes a single step of an in-flight transfer. Index is
+// the XMODEM/YMODEM block number of packet, retransmit and CAN events (0 for
+// ZModem); Size is the payload length of sent/acked packet events; File is
+// set for file events.
+type ProgressEvent struct {
+	Kind  ProgressEventKind
+	Index int
+	Size  int
+	File  File
+}
+
+// ProgressHandler receives transfer events from the same goroutine driving
+// the transfer, so implementations don't need their own synchronization.
+type ProgressHandler interface {
+	OnProgress(ev ProgressEvent)
+}
+
+// ProgressFunc adapts a plain function to ProgressHandler.
+type ProgressFunc func(ev ProgressEvent)
+
+func (f ProgressFunc) OnProgress(ev ProgressEvent) { f(ev) }
+
+func (m *Modem) progress(ev ProgressEvent) {
+	if m.Config.Progress != nil {
+		m.Config.Progress.OnProgress(ev)
+	}
+}
+
+// NewIOProgress returns a ProgressHandler that renders a single, rewritten
+// progress line to w: the current file name, packets transferred so far,
+// and retransmit count.
+func NewIOProgress(w io.Writer) ProgressHandler {
+	p := &ioProgress{w: w}
+	return ProgressFunc(p.onProgress)
+}
+
+type ioProgress struct {
+	w       io.Writer
+	file    string
+	packets int
+	retries int
+	sending bool // PacketSent seen: acks then refer to already counted packets
+}
+
+func (p *ioProgress) onProgress(ev ProgressEvent) {
+	switch ev.Kind {
+	case ProgressFileStart:
+		p.file = ev.File.Path
+		p.packets = 0
+		p.retries = 0
+	case ProgressPacketSent:
+		p.sending = true
+		p.packets++
+	case ProgressPacketAcked:
+		if !p.sending {
+			p.packets++
+		}
+	case ProgressRetransmit:
+		p.retries++
+	}
+	name := p.file
+	if name == "" {
+		name = "-"
+	}
+	fmt.Fprintf(p.w, "\r%s: %d packets, %d retries", name, p.packets, p.retries)
+	if ev.Kind == ProgressFileEnd {
+		fmt.Fprintln(p.w)
+	}
+}
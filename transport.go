@@ -0,0 +1,180 @@
+package xmodem
+
+import (
+	"bufio"
+	"io"
+)
+
+// Transport adapts the XMODEM/YMODEM/ZMODEM byte stream to a link that
+// reserves certain byte values, so the protocol state machines never have
+// to know whether they're talking over a raw serial line, Telnet, or an
+// XON/XOFF-sensitive connection.
+type Transport interface {
+	// EncodePacket transforms an outgoing chunk before it's written to the
+	// underlying writer.
+	EncodePacket(data []byte) []byte
+	// DecodeStream wraps the underlying reader so the protocol only ever
+	// sees decoded bytes.
+	DecodeStream(r io.Reader) io.Reader
+}
+
+// RawTransport writes bytes as-is, the behavior this package always had
+// before Transport existed.
+type RawTransport struct{}
+
+func (RawTransport) EncodePacket(data []byte) []byte    { return data }
+func (RawTransport) DecodeStream(r io.Reader) io.Reader { return r }
+
+const (
+	telnetIAC  byte = 0xFF
+	telnetSB   byte = 0xFA
+	telnetSE   byte = 0xF0
+	telnetWILL byte = 0xFB
+	telnetWONT byte = 0xFC
+	telnetDO   byte = 0xFD
+	telnetDONT byte = 0xFE
+)
+
+// TelnetTransport doubles IAC (0xFF) bytes on the way out, and on the way
+// in undoes that doubling and strips Telnet option negotiation (IAC
+// WILL/WONT/DO/DONT <option> and IAC SB ... IAC SE) so it never reaches
+// the protocol as data.
+type TelnetTransport struct{}
+
+func (TelnetTransport) EncodePacket(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == telnetIAC {
+			out = append(out, telnetIAC, telnetIAC)
+		} else {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func (TelnetTransport) DecodeStream(r io.Reader) io.Reader {
+	return &telnetDecoder{r: bufio.NewReader(r)}
+}
+
+type telnetDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *telnetDecoder) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b != telnetIAC {
+			p[n] = b
+			n++
+			continue
+		}
+		cmd, err := d.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		switch cmd {
+		case telnetIAC:
+			p[n] = telnetIAC
+			n++
+		case telnetSB:
+			if err := d.skipSubnegotiation(); err != nil {
+				return n, err
+			}
+		case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+			if _, err := d.r.ReadByte(); err != nil { // option byte
+				return n, err
+			}
+		default:
+			// unrecognized command, drop it
+		}
+	}
+	return n, nil
+}
+
+func (d *telnetDecoder) skipSubnegotiation() error {
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != telnetIAC {
+			continue
+		}
+		b2, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b2 == telnetSE {
+			return nil
+		}
+	}
+}
+
+const transportZDLE byte = 0x18 // same escape introducer ZMODEM uses
+
+func escapedNeedsEscape(b byte) bool {
+	switch b {
+	case transportZDLE, 0x11, 0x13, 0x8D, 0x91, 0x93: // ZDLE itself, XON/XOFF and their high-bit forms, and CR with the high bit set
+		return true
+	}
+	return false
+}
+
+// EscapedTransport applies ZMODEM-style ZDLE escaping to every byte that
+// crosses the link, not just ZMODEM's own frames, for links that act on
+// XON/XOFF (0x11/0x13) even when the protocol running over them isn't
+// ZMODEM.
+type EscapedTransport struct{}
+
+func (EscapedTransport) EncodePacket(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if escapedNeedsEscape(b) {
+			out = append(out, transportZDLE, b^zdleEsc)
+		} else {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+func (EscapedTransport) DecodeStream(r io.Reader) io.Reader {
+	return &escapedDecoder{r: bufio.NewReader(r)}
+}
+
+type escapedDecoder struct {
+	r *bufio.Reader
+}
+
+func (d *escapedDecoder) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b != transportZDLE {
+			p[n] = b
+			n++
+			continue
+		}
+		e, err := d.r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		p[n] = e ^ zdleEsc
+		n++
+	}
+	return n, nil
+}
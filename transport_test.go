@@ -0,0 +1,141 @@
+package xmodem
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTelnetTransportEncodePacketDoublesIAC(t *testing.T) {
+	in := []byte{0x01, telnetIAC, 0x02, telnetIAC, telnetIAC, 0x03}
+	want := []byte{0x01, telnetIAC, telnetIAC, 0x02, telnetIAC, telnetIAC, telnetIAC, telnetIAC, 0x03}
+	got := TelnetTransport{}.EncodePacket(in)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestTelnetTransportDecodeStreamUndoublesIAC(t *testing.T) {
+	raw := []byte{0x01, telnetIAC, telnetIAC, 0x02}
+	r := TelnetTransport{}.DecodeStream(bytes.NewReader(raw))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	want := []byte{0x01, telnetIAC, 0x02}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestTelnetTransportDecodeStreamStripsOptionNegotiation(t *testing.T) {
+	raw := []byte{0x01, telnetIAC, telnetWILL, 0x03, 0x02, telnetIAC, telnetDONT, 0x2C, 0x03}
+	r := TelnetTransport{}.DecodeStream(bytes.NewReader(raw))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	want := []byte{0x01, 0x02, 0x03}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestTelnetTransportDecodeStreamStripsSubnegotiation(t *testing.T) {
+	raw := []byte{0x01}
+	raw = append(raw, telnetIAC, telnetSB, 0x18, 0x00, 'x', 't', 'e', 'r', 'm', telnetIAC, telnetSE)
+	raw = append(raw, 0x02)
+	r := TelnetTransport{}.DecodeStream(bytes.NewReader(raw))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	want := []byte{0x01, 0x02}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestEscapedTransportEncodeDecodeRoundTrip(t *testing.T) {
+	data := []byte{0x01, transportZDLE, 0x11, 0x13, 0x8D, 0x91, 0x93, 0x20, 'A'}
+	enc := EscapedTransport{}.EncodePacket(data)
+	r := EscapedTransport{}.DecodeStream(bytes.NewReader(enc))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %v, want %v", got, data)
+	}
+}
+
+func TestEscapedTransportEncodePacketOnlyEscapesReservedBytes(t *testing.T) {
+	in := []byte{0x41, 0x42, 0x20, 0x7f}
+	got := EscapedTransport{}.EncodePacket(in)
+	if !bytes.Equal(got, in) {
+		t.Fatalf("got %v, want unchanged %v", got, in)
+	}
+}
+
+// TestTransportPumpConcurrentTryRead pops bytes off one transportPump from
+// several goroutines at once, the way concurrent readCtx/peekCtx callers
+// would, to check tryRead's mutex-guarded pop never double-delivers or
+// drops a byte under contention.
+func TestTransportPumpConcurrentTryRead(t *testing.T) {
+	const n = 4096
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	pump := newTransportPump(bufio.NewReader(bytes.NewReader(data)))
+
+	const workers = 8
+	var mu sync.Mutex
+	got := make([]byte, 0, n)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			one := make([]byte, 1)
+			for {
+				n, err, ok := pump.tryRead(one)
+				if !ok {
+					select {
+					case <-pump.wait():
+						continue
+					case <-time.After(time.Second):
+						t.Errorf("timed out waiting for pump progress")
+						return
+					}
+				}
+				if n > 0 {
+					mu.Lock()
+					got = append(got, one[0])
+					mu.Unlock()
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(got) != n {
+		t.Fatalf("got %d bytes, want %d", len(got), n)
+	}
+	var seen [256]int
+	for _, b := range got {
+		seen[b]++
+	}
+	wantCount := n / 256
+	for b, count := range seen {
+		if count != wantCount {
+			t.Fatalf("byte %d: got %d occurrences, want %d", b, count, wantCount)
+		}
+	}
+}
@@ -0,0 +1,636 @@
+package xmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+)
+
+// ZMODEM frame header types (first data byte of a header).
+const (
+	zrqinit byte = iota // request receiver init
+	zrinit              // receiver capabilities
+	zsinit              // sender capabilities (unused, no TCAPS exchanged)
+	zack                // general ACK
+	zfile               // file name header
+	zskip               // skip this file
+	znak                // request retransmit of last header
+	zabort              // abort batch, same as two CAN
+	zfin                // end of session
+	zrpos               // resume/request data at offset
+	zdata               // data packet(s) follow
+	zeof                // end of file
+	zcan                // cancel, same as 5 CAN
+)
+
+// header framing marks, sent as ZPAD [ZPAD] ZDLE <fmt> ...
+const (
+	zpad   byte = '*'
+	zbin   byte = 'A' // binary header, CRC-16
+	zhex   byte = 'B' // hex header, CRC-16
+	zbin32 byte = 'C' // binary header, CRC-32
+)
+
+// data subpacket terminators, sent as ZDLE <term>.
+const (
+	zcrce byte = 0x68 // frame ends, no ACK expected
+	zcrcg byte = 0x69 // frame continues, streaming, no ACK expected
+	zcrcq byte = 0x6A // frame continues, ACK expected
+	zcrcw byte = 0x6B // frame continues, ACK expected, sender waits for it
+)
+
+const zdleEsc byte = 0x40 // escaped bytes are XORed with this
+
+// ZModemResumeUnseekable is returned by zSendFileBody when the peer replies
+// to a data subpacket with ZRPOS asking to resume at an offset other than
+// the start of the packet just sent, but File.Body doesn't implement
+// io.Seeker so the sender can't seek there.
+var ZModemResumeUnseekable = errors.New("zmodem resume requested but file body is not seekable")
+
+// ZModemBadHexHeader is returned when a hex header's digits don't parse as
+// hex, which usually means the link is desynced.
+var ZModemBadHexHeader = errors.New("zmodem bad hex header")
+
+// ZModemBadCRC is returned by zReadSubpacket when a data subpacket's
+// trailing CRC-16/CRC-32 doesn't match its payload, so the caller can
+// NAK/ZRPOS the peer into resending it instead of handing corrupt data to
+// the Receiver.
+var ZModemBadCRC = errors.New("zmodem subpacket CRC mismatch")
+
+// zmodem capability flags, carried in the data field of ZRINIT/ZFILE headers.
+// the existing ModemFn bits are reinterpreted for ZMODEM: there is no 1K
+// block or plain G-mode here, so those bits instead select crash recovery
+// and streaming behavior.
+const (
+	zModemCanResume  = ModemFn1k     // crash recovery: resume at ZRPOS offset
+	zModemCanStream  = ModemFnG      // streaming ZCRCG checkpoints, no per-packet ACK
+	zModemUseCRC32   = ModemFnCRC    // CRC-32 instead of CRC-16
+	zModemEscapeCtrl = ModemFnCANCAN // escape all control chars, not just ZDLE/XON/XOFF
+)
+
+// zModemCapMask is the subset of ModemFn bits that are real ZMODEM
+// capabilities, exchanged via the first byte of ZRINIT's data field so the
+// sender can tell what the receiver actually supports instead of assuming
+// its own ModemConfig.fn matches. ModemFnBatch isn't part of this: it just
+// says "this is a file list", not something the receiver needs to agree to.
+const zModemCapMask = zModemCanResume | zModemCanStream | zModemUseCRC32 | zModemEscapeCtrl
+
+// ZModemConfig builds a ModemConfig for ZMODEM transfers. fn reuses the
+// ModemFn bits, reinterpreted as zModemCanResume/zModemCanStream/
+// zModemUseCRC32/zModemEscapeCtrl; ModemFnBatch keeps its usual meaning.
+func ZModemConfig(fn ModemFn) ModemConfig {
+	return ModemConfig{
+		mode:      ZModem,
+		fn:        (fn & ModemZMax) | ModemZMin,
+		Retry:     DefaultRetryPolicy,
+		Transport: RawTransport{},
+	}
+}
+
+func zCRC32(data []byte) []byte {
+	sum := crc32.ChecksumIEEE(data)
+	return []byte{byte(sum), byte(sum >> 8), byte(sum >> 16), byte(sum >> 24)}
+}
+
+func zNeedsEscape(b byte, escapeAll bool) bool {
+	if b == charCAN { // ZDLE itself is 0x18, same byte as charCAN
+		return true
+	}
+	bare := b & 0x7f
+	if bare == 0x11 || bare == 0x13 { // XON/XOFF, always escaped
+		return true
+	}
+	if escapeAll && bare < 0x20 {
+		return true
+	}
+	return false
+}
+
+func zdleEncode(data []byte, escapeAll bool) []byte {
+	out := make([]byte, 0, len(data)+4)
+	for _, b := range data {
+		if zNeedsEscape(b, escapeAll) {
+			out = append(out, charCAN, b^zdleEsc)
+		} else {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// zReadEscaped reads exactly n bytes from the transport, undoing ZDLE
+// escaping as it goes.
+func (m *Modem) zReadEscaped(ctx context.Context, n int) ([]byte, error) {
+	buf := make([]byte, 0, n)
+	rBuf := make([]byte, 1)
+	for len(buf) < n {
+		_, err := m.readCtx(ctx, m.Config.Retry.CharTimeout, rBuf)
+		if err != nil {
+			return nil, err
+		}
+		if rBuf[0] != charCAN {
+			buf = append(buf, rBuf[0])
+			continue
+		}
+		_, err = m.readCtx(ctx, m.Config.Retry.CharTimeout, rBuf)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, rBuf[0]^zdleEsc)
+	}
+	return buf, nil
+}
+
+// zReadSubpacket reads a ZDLE-escaped data subpacket up to its terminator,
+// then reads and verifies the trailing CRC-16/CRC-32 that zSendData always
+// appends after the terminator, returning ZModemBadCRC if it doesn't match
+// so the caller can NAK/ZRPOS a retry instead of treating the trailing CRC
+// bytes as payload of the next subpacket. useCRC32 should come from the
+// zfile/zdata header that introduced this data phase (zHeader.crc32), not
+// this side's own Config.fn: the peer may have negotiated down to CRC-16
+// even if this side would itself prefer CRC-32.
+func (m *Modem) zReadSubpacket(ctx context.Context, useCRC32 bool) ([]byte, byte, error) {
+	buf := []byte{}
+	rBuf := make([]byte, 1)
+	for {
+		_, err := m.readCtx(ctx, m.Config.Retry.PacketTimeout, rBuf)
+		if err != nil {
+			return nil, 0, err
+		}
+		if rBuf[0] != charCAN {
+			buf = append(buf, rBuf[0])
+			continue
+		}
+		_, err = m.readCtx(ctx, m.Config.Retry.CharTimeout, rBuf)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch rBuf[0] {
+		case zcrce, zcrcg, zcrcq, zcrcw:
+			term := rBuf[0]
+			crcLen := 2
+			if useCRC32 {
+				crcLen = 4
+			}
+			gotCRC, err := m.zReadEscaped(ctx, crcLen)
+			if err != nil {
+				return nil, 0, err
+			}
+			var wantCRC []byte
+			if useCRC32 {
+				wantCRC = zCRC32(append(append([]byte{}, buf...), term))
+			} else {
+				wantCRC = crc16(append(append([]byte{}, buf...), term))
+			}
+			if !bytes.Equal(gotCRC, wantCRC) {
+				return nil, 0, ZModemBadCRC
+			}
+			return buf, term, nil
+		default:
+			buf = append(buf, rBuf[0]^zdleEsc)
+		}
+	}
+}
+
+type zHeader struct {
+	typ  byte
+	data [4]byte // little-endian position/flags, meaning depends on typ
+
+	// crc32 records whether this header arrived as a CRC-32 binary header
+	// (zbin32) rather than CRC-16 (zbin/zhex). The data subpackets that
+	// follow a zfile/zdata header always use the same CRC width as that
+	// header itself, so callers reading subpackets after it should use
+	// this instead of the reader's own static Config.fn: a receiver's
+	// local zModemUseCRC32 bit only says what it's willing to accept, not
+	// what the peer - who may have negotiated down - actually sent.
+	crc32 bool
+}
+
+func zHeaderPos(pos int64) [4]byte {
+	return [4]byte{byte(pos), byte(pos >> 8), byte(pos >> 16), byte(pos >> 24)}
+}
+
+func (h zHeader) pos() int64 {
+	return int64(h.data[0]) | int64(h.data[1])<<8 | int64(h.data[2])<<16 | int64(h.data[3])<<24
+}
+
+func (m *Modem) zSendHeader(h zHeader) error {
+	body := append([]byte{h.typ}, h.data[:]...)
+	useCRC32 := m.Config.fn&zModemUseCRC32 != 0
+	var crc []byte
+	if useCRC32 {
+		crc = zCRC32(body)
+	} else {
+		crc = crc16(body)
+	}
+	out := []byte{zpad, charCAN}
+	if useCRC32 {
+		out = append(out, zbin32)
+	} else {
+		out = append(out, zbin)
+	}
+	out = append(out, zdleEncode(append(body, crc...), m.Config.fn&zModemEscapeCtrl != 0)...)
+	_, err := m.writeTransport(out)
+	return err
+}
+
+func hexDigit(n byte) byte {
+	if n < 10 {
+		return '0' + n
+	}
+	return 'a' + n - 10
+}
+
+func hexNibble(b byte) (byte, bool) {
+	switch {
+	case b >= '0' && b <= '9':
+		return b - '0', true
+	case b >= 'a' && b <= 'f':
+		return b - 'a' + 10, true
+	case b >= 'A' && b <= 'F':
+		return b - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// zSendHexHeader sends h as a hex header: ZRINIT and ZFIN are conventionally
+// sent this way, CRC-16 and all, so a standard rz/sz peer that opens the
+// session with a hex header can be answered in kind. The ZPAD-ZPAD prefix
+// (not a single ZPAD) is what real rz/sz emit and expect.
+func (m *Modem) zSendHexHeader(h zHeader) error {
+	body := append([]byte{h.typ}, h.data[:]...)
+	crc := crc16(body)
+	out := []byte{zpad, zpad, charCAN, zhex}
+	for _, b := range append(body, crc...) {
+		out = append(out, hexDigit(b>>4), hexDigit(b&0xf))
+	}
+	out = append(out, '\r', '\n')
+	_, err := m.writeTransport(out)
+	return err
+}
+
+// zReadHexHeader reads a hex header's 5 body bytes and 2-byte CRC-16 (hex
+// headers are always CRC-16, never CRC-32) after the format byte has
+// already been consumed by zWaitHeader, then discards the trailing CR/LF/XON
+// that's already arrived. It only drains bytes the pump has already
+// buffered rather than waiting on CharTimeout for more: the peer's next
+// header follows immediately in the common case, and blocking here would
+// eat into that header's own HandshakeTimeout before zWaitHeader ever gets
+// to wait for it.
+func (m *Modem) zReadHexHeader(ctx context.Context) (zHeader, error) {
+	raw := make([]byte, 7) // type + 4 data bytes + 2 CRC-16 bytes
+	digit := make([]byte, 1)
+	for i := range raw {
+		var hi, lo byte
+		if _, err := m.readCtx(ctx, m.Config.Retry.CharTimeout, digit); err != nil {
+			return zHeader{}, err
+		}
+		var ok bool
+		if hi, ok = hexNibble(digit[0]); !ok {
+			return zHeader{}, ZModemBadHexHeader
+		}
+		if _, err := m.readCtx(ctx, m.Config.Retry.CharTimeout, digit); err != nil {
+			return zHeader{}, err
+		}
+		if lo, ok = hexNibble(digit[0]); !ok {
+			return zHeader{}, ZModemBadHexHeader
+		}
+		raw[i] = hi<<4 | lo
+	}
+	for {
+		peek, err, ok := m.pump.tryPeek(1)
+		if !ok || err != nil || (peek[0] != '\r' && peek[0] != '\n' && peek[0] != 0x11) {
+			break
+		}
+		m.pump.consume(1)
+	}
+	var h zHeader
+	h.typ = raw[0]
+	copy(h.data[:], raw[1:5])
+	return h, nil
+}
+
+// zWaitHeader scans the transport for a header, forwarding other bytes to
+// the terminal, same as waitWorkMode does for XMODEM. A lone CAN, and a ZPAD
+// run not followed by ZDLE together with the byte after it, are dropped
+// rather than forwarded.
+func (m *Modem) zWaitHeader(ctx context.Context) (zHeader, error) {
+	rBuf := make([]byte, 1)
+	for {
+		_, err := m.readCtx(ctx, m.Config.Retry.HandshakeTimeout, rBuf)
+		if err != nil {
+			return zHeader{}, err
+		}
+		b := rBuf[0]
+		if b == charCAN {
+			peek, err := m.peekCtx(ctx, m.Config.Retry.CharTimeout, 1)
+			if err == nil && peek[0] == charCAN {
+				m.pump.consume(1)
+				return zHeader{typ: zcan}, nil
+			}
+			continue
+		}
+		if b != zpad {
+			m.termR.Write([]byte{b})
+			continue
+		}
+		// a header starts with one-or-more ZPAD bytes before ZDLE; real
+		// rz/sz emit ZPAD ZPAD ZDLE for hex headers (see zSendHexHeader) and
+		// a single ZPAD for binary ones (see zSendHeader), so skip any run
+		// of them instead of only tolerating exactly one.
+		for rBuf[0] == zpad {
+			_, err = m.readCtx(ctx, m.Config.Retry.CharTimeout, rBuf)
+			if err != nil {
+				return zHeader{}, err
+			}
+		}
+		if rBuf[0] != charCAN {
+			continue
+		}
+		_, err = m.readCtx(ctx, m.Config.Retry.CharTimeout, rBuf)
+		if err != nil {
+			return zHeader{}, err
+		}
+		if rBuf[0] == zhex {
+			return m.zReadHexHeader(ctx)
+		}
+		useCRC32 := rBuf[0] == zbin32
+		n := 5 + 2
+		if useCRC32 {
+			n = 5 + 4
+		}
+		raw, err := m.zReadEscaped(ctx, n)
+		if err != nil {
+			return zHeader{}, err
+		}
+		var h zHeader
+		h.typ = raw[0]
+		h.crc32 = useCRC32
+		copy(h.data[:], raw[1:5])
+		return h, nil
+	}
+}
+
+func (m *Modem) zSendData(data []byte, term byte) error {
+	useCRC32 := m.Config.fn&zModemUseCRC32 != 0
+	var crc []byte
+	if useCRC32 {
+		crc = zCRC32(append(append([]byte{}, data...), term))
+	} else {
+		crc = crc16(append(append([]byte{}, data...), term))
+	}
+	escapeAll := m.Config.fn&zModemEscapeCtrl != 0
+	out := zdleEncode(data, escapeAll)
+	out = append(out, charCAN, term)
+	out = append(out, zdleEncode(crc, escapeAll)...)
+	_, err := m.writeTransport(out)
+	return err
+}
+
+func zFileInfo(file File) []byte {
+	info := append([]byte(file.Path), 0)
+	info = append(info, fmt.Sprintf("%d %o %o 0 %d", file.Length, file.ModTime.Unix(), file.Mode&fs.ModePerm, file.ResumeOffset)...)
+	return append(info, 0)
+}
+
+func (m *Modem) sendZModem(ctx context.Context, files []File) error {
+	rinit, err := m.zWaitHeader(ctx)
+	if err != nil {
+		return err
+	}
+	// Narrow our capability bits down to ones the receiver actually
+	// advertised in ZRINIT, so two independently-configured ModemConfigs
+	// can't silently disagree on CRC width (or streaming/resume/escaping)
+	// and have every header/subpacket CRC check fail against each other.
+	peerCaps := ModemFn(rinit.data[0])
+	m.Config.fn = (m.Config.fn &^ zModemCapMask) | (m.Config.fn & zModemCapMask & peerCaps)
+	for _, file := range files {
+		m.progress(ProgressEvent{Kind: ProgressFileStart, File: file})
+		var resp zHeader
+		naks := 0
+		for {
+			if err := m.zSendHeader(zHeader{typ: zfile}); err != nil {
+				return err
+			}
+			if err := m.zSendData(zFileInfo(file), zcrcw); err != nil {
+				return err
+			}
+			r, err := m.zWaitHeader(ctx)
+			if err != nil {
+				return err
+			}
+			if r.typ == znak {
+				naks++
+				if naks >= m.Config.Retry.MaxNAKs {
+					return NAKTenTimes
+				}
+				continue
+			}
+			resp = r
+			break
+		}
+		if resp.typ == zskip {
+			continue
+		}
+		offset := resp.pos()
+		if file.Body != nil && offset > 0 {
+			if _, err := io.CopyN(io.Discard, file.Body, offset); err != nil && err != io.EOF {
+				return err
+			}
+		}
+		if err := m.zSendHeader(zHeader{typ: zdata, data: zHeaderPos(offset)}); err != nil {
+			return err
+		}
+		if err := m.zSendFileBody(ctx, file.Body, offset); err != nil {
+			return err
+		}
+		m.progress(ProgressEvent{Kind: ProgressFileEnd, File: file})
+	}
+	if err := m.zSendHexHeader(zHeader{typ: zfin}); err != nil {
+		return err
+	}
+	_, err = m.zWaitHeader(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = m.writeTransport([]byte("OO"))
+	return err
+}
+
+func (m *Modem) zSendFileBody(ctx context.Context, body io.Reader, offset int64) error {
+	if body == nil {
+		return m.zSendHeader(zHeader{typ: zeof, data: zHeaderPos(offset)})
+	}
+	streaming := m.Config.fn&zModemCanStream != 0
+	buf := make([]byte, 1024)
+	total := offset
+	naks := 0
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			total += int64(n)
+			term := zcrcw
+			if streaming {
+				term = zcrcg
+			}
+			if err := m.zSendData(buf[:n], term); err != nil {
+				return err
+			}
+			m.progress(ProgressEvent{Kind: ProgressPacketSent, Size: n})
+			if !streaming {
+			retransmit:
+				resp, err := m.zWaitHeader(ctx)
+				if err != nil {
+					return err
+				}
+				switch resp.typ {
+				case zack:
+					m.progress(ProgressEvent{Kind: ProgressPacketAcked, Size: n})
+					naks = 0
+				case znak, zrpos:
+					naks++
+					if naks >= m.Config.Retry.MaxNAKs {
+						return NAKTenTimes
+					}
+					pos := total - int64(n)
+					if resp.typ == zrpos {
+						pos = resp.pos()
+					}
+					if pos == total-int64(n) {
+						// retransmit of the packet still in buf
+						if err := m.zSendData(buf[:n], term); err != nil {
+							return err
+						}
+						goto retransmit
+					}
+					seeker, ok := body.(io.Seeker)
+					if !ok {
+						return ZModemResumeUnseekable
+					}
+					if _, err := seeker.Seek(pos, io.SeekStart); err != nil {
+						return err
+					}
+					total = pos
+				case zcan, zabort:
+					return IOCan
+				default:
+					return m.zSendHeader(zHeader{typ: zeof, data: zHeaderPos(total)})
+				}
+			}
+		}
+		if err == io.EOF {
+			if err := m.zSendData([]byte{}, zcrce); err != nil {
+				return err
+			}
+			return m.zSendHeader(zHeader{typ: zeof, data: zHeaderPos(total)})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Modem) receiveZModem(ctx context.Context, fn Receiver) error {
+	caps := zHeaderPos(int64(m.Config.fn & zModemCapMask))
+	if err := m.zSendHexHeader(zHeader{typ: zrinit, data: caps}); err != nil {
+		return err
+	}
+	for {
+		h, err := m.zWaitHeader(ctx)
+		if err != nil {
+			return err
+		}
+		if h.typ == zfin {
+			m.zSendHexHeader(zHeader{typ: zfin})
+			return nil
+		}
+		if h.typ != zfile {
+			continue
+		}
+		info, _, err := m.zReadSubpacket(ctx, h.crc32)
+		if err == ZModemBadCRC {
+			m.zSendHeader(zHeader{typ: znak})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		file, err := parseZFileInfo(info)
+		if err != nil {
+			return err
+		}
+		offset := int64(0)
+		if m.Config.ResumeFrom != nil && m.Config.fn&zModemCanResume != 0 {
+			offset = m.Config.ResumeFrom(*file)
+		}
+		file.ResumeOffset = offset
+		if err := m.zSendHeader(zHeader{typ: zrpos, data: zHeaderPos(offset)}); err != nil {
+			return err
+		}
+		m.progress(ProgressEvent{Kind: ProgressFileStart, File: *file})
+		br, bw := io.Pipe()
+		file.Body = br
+		go func() {
+			fn(*file)
+		}()
+		written := offset
+		for {
+			dh, err := m.zWaitHeader(ctx)
+			if err != nil {
+				bw.CloseWithError(err)
+				return err
+			}
+			if dh.typ == zeof {
+				break
+			}
+			if dh.typ != zdata {
+				continue
+			}
+			for {
+				data, term, err := m.zReadSubpacket(ctx, dh.crc32)
+				if err == ZModemBadCRC {
+					// ask the sender to resume right after the last good
+					// subpacket instead of handing fn corrupt data.
+					m.zSendHeader(zHeader{typ: zrpos, data: zHeaderPos(written)})
+					continue
+				}
+				if err != nil {
+					bw.CloseWithError(err)
+					return err
+				}
+				bw.Write(data)
+				written += int64(len(data))
+				m.progress(ProgressEvent{Kind: ProgressPacketAcked, Size: len(data)})
+				if term == zcrcw {
+					m.zSendHeader(zHeader{typ: zack})
+				}
+				if term == zcrce {
+					break
+				}
+			}
+		}
+		bw.Close()
+		m.progress(ProgressEvent{Kind: ProgressFileEnd, File: *file})
+	}
+}
+
+func parseZFileInfo(buf []byte) (*File, error) {
+	base, err := parseFileInfo(buf)
+	if err != nil {
+		return nil, err
+	}
+	nul := 0
+	for nul < len(buf) && buf[nul] != 0 {
+		nul++
+	}
+	var length int64
+	var modTime, mode, pad int64
+	var resume int64
+	fmt.Sscanf(string(buf[nul+1:]), "%d%o%o%d%d", &length, &modTime, &mode, &pad, &resume)
+	base.ResumeOffset = resume
+	return base, nil
+}
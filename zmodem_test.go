@@ -0,0 +1,287 @@
+package xmodem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+// newZLoopback wires up two Modems over a pair of pipes and activates their
+// demuxes, the way SendBytesContext/ReceiveContext would, so bytes route to
+// the protocol reader instead of the (here, unread) terminal reader.
+func newZLoopback(cfg ModemConfig) (*Modem, *Modem) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	sender, _, _ := NewModem(cfg, br, aw)
+	receiver, _, _ := NewModem(cfg, ar, bw)
+	sender.demux.activate()
+	receiver.demux.activate()
+	return sender, receiver
+}
+
+func TestZHeaderRoundTrip(t *testing.T) {
+	for _, useCRC32 := range []bool{false, true} {
+		fn := ModemFn(0)
+		if useCRC32 {
+			fn = zModemUseCRC32
+		}
+		sender, receiver := newZLoopback(ZModemConfig(fn))
+		want := zHeader{typ: zfile, data: zHeaderPos(12345)}
+
+		errCh := make(chan error, 1)
+		go func() { errCh <- sender.zSendHeader(want) }()
+
+		got, err := receiver.zWaitHeader(context.Background())
+		if err != nil {
+			t.Fatalf("zWaitHeader: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("zSendHeader: %v", err)
+		}
+		if got.typ != want.typ || got.pos() != want.pos() {
+			t.Fatalf("useCRC32=%v: got %+v, want %+v", useCRC32, got, want)
+		}
+	}
+}
+
+func TestZHexHeaderRoundTrip(t *testing.T) {
+	cfg := ZModemConfig(0)
+	// zReadHexHeader only drains the trailing CR/LF already buffered and never
+	// waits for more after the header; the short CharTimeout bounds its
+	// per-digit reads, so a truncated header fails instead of hanging.
+	cfg.Retry.CharTimeout = 20 * time.Millisecond
+	sender, receiver := newZLoopback(cfg)
+	want := zHeader{typ: zrinit, data: zHeaderPos(42)}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- sender.zSendHexHeader(want) }()
+
+	got, err := receiver.zWaitHeader(context.Background())
+	if err != nil {
+		t.Fatalf("zWaitHeader: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("zSendHexHeader: %v", err)
+	}
+	if got.typ != want.typ || got.pos() != want.pos() {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+// TestZWaitHeaderRealRzSzFraming feeds zWaitHeader a hand-built hex header
+// in the exact wire format a real rz/sz emits (ZPAD ZPAD ZDLE 'B' <hex
+// digits> CRLF), rather than one produced by this library's own
+// zSendHexHeader, so a regression in either side's framing independently
+// (as happened when 5fbea7e silently reverted zSendHexHeader's ZPAD-ZPAD
+// prefix to a single ZPAD) shows up here instead of only in round-trip
+// tests where both ends could drift the same way.
+func TestZWaitHeaderRealRzSzFraming(t *testing.T) {
+	for _, zpadCount := range []int{1, 2, 3} {
+		cfg := ZModemConfig(0)
+		cfg.Retry.CharTimeout = 20 * time.Millisecond
+		ar, aw := io.Pipe()
+		receiver, _, _ := NewModem(cfg, ar, io.Discard)
+		receiver.demux.activate()
+
+		body := []byte{zrinit, 0, 0, 0, 0}
+		crc := crc16(body)
+		raw := bytes.Repeat([]byte{zpad}, zpadCount)
+		raw = append(raw, charCAN, zhex)
+		for _, b := range append(body, crc...) {
+			raw = append(raw, hexDigit(b>>4), hexDigit(b&0xf))
+		}
+		raw = append(raw, '\r', '\n')
+
+		errCh := make(chan error, 1)
+		go func() { _, err := aw.Write(raw); errCh <- err }()
+
+		got, err := receiver.zWaitHeader(context.Background())
+		if err != nil {
+			t.Fatalf("zpadCount=%d: zWaitHeader: %v", zpadCount, err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("zpadCount=%d: write: %v", zpadCount, err)
+		}
+		if got.typ != zrinit || got.pos() != 0 {
+			t.Fatalf("zpadCount=%d: got %+v, want zrinit/0", zpadCount, got)
+		}
+	}
+}
+
+func TestZdleEncodeDecodeRoundTrip(t *testing.T) {
+	data := []byte{0x01, 0x11, 0x13, 0x18, 0x7f, 0x20, 'A'}
+	for _, escapeAll := range []bool{false, true} {
+		enc := zdleEncode(data, escapeAll)
+		dec := make([]byte, 0, len(data))
+		for i := 0; i < len(enc); i++ {
+			if enc[i] == charCAN {
+				i++
+				dec = append(dec, enc[i]^zdleEsc)
+			} else {
+				dec = append(dec, enc[i])
+			}
+		}
+		if !bytes.Equal(dec, data) {
+			t.Fatalf("escapeAll=%v: got %v, want %v", escapeAll, dec, data)
+		}
+	}
+}
+
+// TestZSendReceiveRoundTrip exercises sendZModem/receiveZModem end to end
+// over newZLoopback, with a body spanning several 1024-byte subpackets so a
+// leaked/misread trailing CRC would corrupt later packets instead of just
+// the first one.
+func TestZSendReceiveRoundTrip(t *testing.T) {
+	for _, useCRC32 := range []bool{false, true} {
+		fn := ModemFn(0)
+		if useCRC32 {
+			fn = zModemUseCRC32
+		}
+		sender, receiver := newZLoopback(ZModemConfig(fn))
+		want := bytes.Repeat([]byte("hello world, zmodem payload "), 200) // > 2 subpackets
+
+		file := File{Path: "payload.bin", Length: int64(len(want)), Body: bytes.NewReader(want)}
+
+		gotCh := make(chan []byte, 1)
+		fileErrCh := make(chan error, 1)
+		go func() {
+			receiver.receiveZModem(context.Background(), func(f File) {
+				data, err := io.ReadAll(f.Body)
+				if err != nil {
+					fileErrCh <- err
+					return
+				}
+				gotCh <- data
+			})
+		}()
+
+		if err := sender.sendZModem(context.Background(), []File{file}); err != nil {
+			t.Fatalf("sendZModem: %v", err)
+		}
+
+		select {
+		case got := <-gotCh:
+			if !bytes.Equal(got, want) {
+				t.Fatalf("useCRC32=%v: got %d bytes, want %d bytes (content mismatch)", useCRC32, len(got), len(want))
+			}
+		case err := <-fileErrCh:
+			t.Fatalf("useCRC32=%v: receiveZModem file callback: %v", useCRC32, err)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("useCRC32=%v: timed out waiting for received file", useCRC32)
+		}
+	}
+}
+
+// TestZRinitCRCNegotiation configures the sender to want CRC-32 while the
+// receiver only advertises CRC-16 support in ZRINIT, the way two
+// independently-constructed ModemConfigs could disagree. sendZModem must
+// narrow down to what the receiver actually advertised instead of using its
+// own ModemConfig.fn unconditionally, or every header/subpacket CRC check
+// would fail against the receiver's CRC-16 expectations.
+func TestZRinitCRCNegotiation(t *testing.T) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	sender, _, _ := NewModem(ZModemConfig(zModemUseCRC32), br, aw)
+	receiver, _, _ := NewModem(ZModemConfig(0), ar, bw)
+	sender.demux.activate()
+	receiver.demux.activate()
+
+	want := bytes.Repeat([]byte("negotiate me"), 50)
+	file := File{Path: "negotiate.bin", Length: int64(len(want)), Body: bytes.NewReader(want)}
+
+	gotCh := make(chan []byte, 1)
+	fileErrCh := make(chan error, 1)
+	go func() {
+		receiver.receiveZModem(context.Background(), func(f File) {
+			data, err := io.ReadAll(f.Body)
+			if err != nil {
+				fileErrCh <- err
+				return
+			}
+			gotCh <- data
+		})
+	}()
+
+	if err := sender.sendZModem(context.Background(), []File{file}); err != nil {
+		t.Fatalf("sendZModem: %v", err)
+	}
+	if sender.Config.fn&zModemUseCRC32 != 0 {
+		t.Fatalf("sender kept CRC32 after receiver advertised no support for it")
+	}
+
+	select {
+	case got := <-gotCh:
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes, want %d bytes (content mismatch)", len(got), len(want))
+		}
+	case err := <-fileErrCh:
+		t.Fatalf("receiveZModem file callback: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for received file")
+	}
+}
+
+// TestZReceiveSubpacketCRCWidthFollowsHeader configures the receiver to
+// advertise CRC-32 in ZRINIT while the sender itself only wants CRC-16, the
+// reverse of TestZRinitCRCNegotiation. Negotiation only ever narrows the
+// sender down, so the sender keeps using CRC-16; the receiver must read
+// subpacket CRCs at the width the zfile/zdata header it just got actually
+// used (zHeader.crc32), not the width its own local Config.fn advertised, or
+// it reads the wrong number of trailing CRC bytes and desyncs.
+func TestZReceiveSubpacketCRCWidthFollowsHeader(t *testing.T) {
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+	sender, _, _ := NewModem(ZModemConfig(0), br, aw)
+	receiver, _, _ := NewModem(ZModemConfig(zModemUseCRC32), ar, bw)
+	sender.demux.activate()
+	receiver.demux.activate()
+
+	want := bytes.Repeat([]byte("reverse negotiate me"), 50)
+	file := File{Path: "reverse.bin", Length: int64(len(want)), Body: bytes.NewReader(want)}
+
+	gotCh := make(chan []byte, 1)
+	fileErrCh := make(chan error, 1)
+	go func() {
+		receiver.receiveZModem(context.Background(), func(f File) {
+			data, err := io.ReadAll(f.Body)
+			if err != nil {
+				fileErrCh <- err
+				return
+			}
+			gotCh <- data
+		})
+	}()
+
+	if err := sender.sendZModem(context.Background(), []File{file}); err != nil {
+		t.Fatalf("sendZModem: %v", err)
+	}
+
+	select {
+	case got := <-gotCh:
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes, want %d bytes (content mismatch)", len(got), len(want))
+		}
+	case err := <-fileErrCh:
+		t.Fatalf("receiveZModem file callback: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for received file")
+	}
+}
+
+func TestHexDigitNibbleRoundTrip(t *testing.T) {
+	for b := 0; b < 256; b++ {
+		hi, ok := hexNibble(hexDigit(byte(b) >> 4))
+		if !ok {
+			t.Fatalf("hexNibble/hexDigit high nibble of %#x not ok", b)
+		}
+		lo, ok := hexNibble(hexDigit(byte(b) & 0xf))
+		if !ok {
+			t.Fatalf("hexNibble/hexDigit low nibble of %#x not ok", b)
+		}
+		if got := hi<<4 | lo; got != byte(b) {
+			t.Fatalf("got %#x, want %#x", got, b)
+		}
+	}
+}